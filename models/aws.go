@@ -0,0 +1,28 @@
+package models
+
+import (
+	"os"
+
+	"github.com/convox/kernel/Godeps/_workspace/src/github.com/awslabs/aws-sdk-go/aws"
+	"github.com/convox/kernel/Godeps/_workspace/src/github.com/awslabs/aws-sdk-go/service/elb"
+	"github.com/convox/kernel/Godeps/_workspace/src/github.com/awslabs/aws-sdk-go/service/kms"
+)
+
+func config() *aws.Config {
+	return &aws.Config{
+		Credentials: aws.DetectCreds(os.Getenv("AWS_ACCESS"), os.Getenv("AWS_SECRET"), ""),
+		Region:      os.Getenv("AWS_REGION"),
+	}
+}
+
+// KMS returns a client for the KMS service, configured the same way as the
+// other AWS client accessors (ECS, DynamoDB, CloudFormation).
+func KMS() *kms.KMS {
+	return kms.New(config())
+}
+
+// ELB returns a client for the classic Elastic Load Balancing service, used
+// to check canary target health during a canary rollout.
+func ELB() *elb.ELB {
+	return elb.New(config())
+}
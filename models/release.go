@@ -1,17 +1,40 @@
 package models
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
 	"encoding/json"
 	"fmt"
+	"os"
 	"os/exec"
 	"time"
 
 	"github.com/convox/kernel/Godeps/_workspace/src/github.com/awslabs/aws-sdk-go/aws"
 	"github.com/convox/kernel/Godeps/_workspace/src/github.com/awslabs/aws-sdk-go/service/cloudformation"
 	"github.com/convox/kernel/Godeps/_workspace/src/github.com/awslabs/aws-sdk-go/service/dynamodb"
-	"github.com/convox/kernel/Godeps/_workspace/src/github.com/awslabs/aws-sdk-go/service/ecs"
+	"github.com/convox/kernel/Godeps/_workspace/src/github.com/awslabs/aws-sdk-go/service/kms"
+	"github.com/convox/kernel/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/convox/kernel/crypt"
 )
 
+// CanaryStrategy describes a gradual, health-gated rollout of a new task
+// definition alongside the existing ECS services rather than updating them
+// in place.
+type CanaryStrategy struct {
+	Steps        []int // percentage of DesiredCount to shift at each step, e.g. [10, 25, 50, 100]
+	PollInterval time.Duration
+	StepTimeout  time.Duration
+}
+
+// DefaultCanaryStrategy supplies the steps and step timing for any of those
+// fields a caller leaves zero.
+var DefaultCanaryStrategy = CanaryStrategy{
+	Steps:        []int{10, 25, 50, 100},
+	PollInterval: 15 * time.Second,
+	StepTimeout:  10 * time.Minute,
+}
+
 type Release struct {
 	Id string
 
@@ -25,6 +48,23 @@ type Release struct {
 	Tasks    map[string]string
 
 	Created time.Time
+
+	// CanaryStep/CanaryService/CanaryDecision track in-flight canary
+	// rollout progress per process name, mirroring Tasks, so that
+	// PromoteCanary/AbortCanary can resume or abort each process's
+	// rollout independently after a restart instead of one process's
+	// state clobbering another's.
+	CanaryStep     map[string]int
+	CanaryService  map[string]string
+	CanaryDecision map[string]string
+
+	RolledBackFrom string
+
+	// envCiphertextFor is the Env value last encrypted and uploaded to S3
+	// by persist(), so repeated persist() calls while Env is unchanged
+	// (e.g. across canary step progress saves) don't re-run KMS
+	// GenerateDataKey and S3 PutObject on every call.
+	envCiphertextFor string
 }
 
 type Releases []Release
@@ -102,6 +142,208 @@ func GetRelease(cluster, app, id string) (*Release, error) {
 	return release, nil
 }
 
+// Previous returns the most recent release of r's app that predates r and
+// is no longer active, i.e. the last known-good release to fall back to.
+func (r *Release) Previous() (*Release, error) {
+	app, err := GetApp(r.Cluster, r.App)
+
+	if err != nil {
+		return nil, err
+	}
+
+	req := &dynamodb.QueryInput{
+		KeyConditions: &map[string]*dynamodb.Condition{
+			"app": &dynamodb.Condition{
+				AttributeValueList: []*dynamodb.AttributeValue{
+					&dynamodb.AttributeValue{S: aws.String(r.App)},
+				},
+				ComparisonOperator: aws.String("EQ"),
+			},
+		},
+		IndexName:        aws.String("app.created"),
+		ScanIndexForward: aws.Boolean(false),
+		TableName:        aws.String(releasesTable(r.Cluster, r.App)),
+	}
+
+	res, err := DynamoDB().Query(req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	releases := make(Releases, len(res.Items))
+
+	for i, item := range res.Items {
+		releases[i] = *releaseFromItem(*item)
+		releases[i].Active = (app.Release == releases[i].Id)
+	}
+
+	previous := selectPrevious(releases, r.Created)
+
+	if previous == nil {
+		return nil, fmt.Errorf("no previous release for %s", r.App)
+	}
+
+	return previous, nil
+}
+
+// selectPrevious scans releases (assumed newest-first, as returned by the
+// app.created GSI) for the most recent one that is no longer active and
+// predates before, i.e. the last known-good release to roll back to.
+func selectPrevious(releases Releases, before time.Time) *Release {
+	for i := range releases {
+		release := releases[i]
+
+		if release.Active || !release.Created.Before(before) {
+			continue
+		}
+
+		return &release
+	}
+
+	return nil
+}
+
+// Rollback finds the last known-good release and promotes it again,
+// recording on it which release it was rolled back from so the history
+// stays auditable.
+func (r *Release) Rollback() (*Release, error) {
+	previous, err := r.Previous()
+
+	if err != nil {
+		return nil, err
+	}
+
+	previous.RolledBackFrom = r.Id
+
+	if err := previous.persist(); err != nil {
+		return nil, err
+	}
+
+	if err := previous.Promote(PromoteOptions{}); err != nil {
+		return nil, err
+	}
+
+	return previous, nil
+}
+
+// EnvDiff describes how a single environment variable changed between two
+// releases.
+type EnvDiff struct {
+	From string
+	To   string
+}
+
+// ProcessDiff describes how a single process's image or command changed
+// between two releases.
+type ProcessDiff struct {
+	Name        string
+	FromImage   string
+	ToImage     string
+	FromCommand string
+	ToCommand   string
+}
+
+// ReleaseDiff summarizes what would change if a release were promoted in
+// place of another, so operators can preview a rollback before running it.
+type ReleaseDiff struct {
+	EnvAdded   map[string]string
+	EnvRemoved map[string]string
+	EnvChanged map[string]EnvDiff
+	Processes  []ProcessDiff
+}
+
+// Diff compares r against other, returning the environment and per-process
+// deltas between them.
+func (r *Release) Diff(other *Release) ReleaseDiff {
+	env, err := r.Environment()
+
+	if err != nil {
+		fmt.Printf("err %+v\n", err)
+		env = Environment{}
+	}
+
+	oenv, err := other.Environment()
+
+	if err != nil {
+		fmt.Printf("err %+v\n", err)
+		oenv = Environment{}
+	}
+
+	specs, err := r.ProcessSpecs()
+
+	if err != nil {
+		fmt.Printf("err %+v\n", err)
+	}
+
+	ospecs, err := other.ProcessSpecs()
+
+	if err != nil {
+		fmt.Printf("err %+v\n", err)
+	}
+
+	added, removed, changed := diffEnvironment(env, oenv)
+
+	return ReleaseDiff{
+		EnvAdded:   added,
+		EnvRemoved: removed,
+		EnvChanged: changed,
+		Processes:  diffProcessSpecs(specs, ospecs),
+	}
+}
+
+// diffEnvironment compares env against oenv, returning the variables added,
+// removed, and changed in oenv relative to env.
+func diffEnvironment(env, oenv Environment) (map[string]string, map[string]string, map[string]EnvDiff) {
+	added := map[string]string{}
+	removed := map[string]string{}
+	changed := map[string]EnvDiff{}
+
+	for key, value := range oenv {
+		if _, ok := env[key]; !ok {
+			added[key] = value
+		} else if env[key] != value {
+			changed[key] = EnvDiff{From: env[key], To: value}
+		}
+	}
+
+	for key, value := range env {
+		if _, ok := oenv[key]; !ok {
+			removed[key] = value
+		}
+	}
+
+	return added, removed, changed
+}
+
+// diffProcessSpecs compares specs against ospecs by process name, returning
+// a ProcessDiff for every process whose image or command differs.
+func diffProcessSpecs(specs, ospecs []ProcessSpec) []ProcessDiff {
+	byName := map[string]ProcessSpec{}
+
+	for _, spec := range specs {
+		byName[spec.Name] = spec
+	}
+
+	diffs := []ProcessDiff{}
+
+	for _, ospec := range ospecs {
+		spec := byName[ospec.Name]
+
+		if spec.Image != ospec.Image || spec.Command != ospec.Command {
+			diffs = append(diffs, ProcessDiff{
+				Name:        ospec.Name,
+				FromImage:   spec.Image,
+				ToImage:     ospec.Image,
+				FromCommand: spec.Command,
+				ToCommand:   ospec.Command,
+			})
+		}
+	}
+
+	return diffs
+}
+
 func (r *Release) Cleanup() error {
 	app, err := GetApp(r.Cluster, r.App)
 
@@ -116,10 +358,57 @@ func (r *Release) Cleanup() error {
 		return err
 	}
 
+	// delete encrypted env, if any
+	err = s3Delete(app.Outputs["Settings"], envCiphertextKey(r.Id))
+
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
+// Environment returns r's environment variables, transparently decrypting
+// them if the app was deployed with a KMS key and the env was therefore
+// stored as ciphertext in S3 rather than plaintext in DynamoDB.
+func (r *Release) Environment() (Environment, error) {
+	app, err := GetApp(r.Cluster, r.App)
+
+	if err != nil {
+		return nil, err
+	}
+
+	key := app.Parameters["Key"]
+
+	if key == "" {
+		return LoadEnvironment([]byte(r.Env)), nil
+	}
+
+	data, err := s3Get(app.Outputs["Settings"], envCiphertextKey(r.Id))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return r.decryptEnvironment(key, data)
+}
+
+// Save persists r and submits it to the current Scheduler, registering
+// task definitions and bringing services up to match. Callers that only
+// need to persist metadata on an already-deployed release (canary step
+// progress, RolledBackFrom) without re-triggering a deploy should use
+// persist() instead.
 func (r *Release) Save() error {
+	if err := r.persist(); err != nil {
+		return err
+	}
+
+	return CurrentScheduler().Submit(context.Background(), r)
+}
+
+// persist writes r's metadata to DynamoDB (and its encrypted environment to
+// S3, if applicable) without submitting it to the Scheduler.
+func (r *Release) persist() error {
 	if r.Id == "" {
 		return fmt.Errorf("Id must not be blank")
 	}
@@ -128,12 +417,28 @@ func (r *Release) Save() error {
 		r.Created = time.Now()
 	}
 
-	err := r.registerTasks()
+	app, err := GetApp(r.Cluster, r.App)
 
 	if err != nil {
 		return err
 	}
 
+	key := app.Parameters["Key"]
+
+	if key != "" && r.Env != "" && r.envCiphertextFor != r.Env {
+		data, err := r.encryptEnvironment(key)
+
+		if err != nil {
+			return err
+		}
+
+		if err := s3Put(app.Outputs["Settings"], envCiphertextKey(r.Id), data); err != nil {
+			return err
+		}
+
+		r.envCiphertextFor = r.Env
+	}
+
 	req := &dynamodb.PutItemInput{
 		Item: &map[string]*dynamodb.AttributeValue{
 			"id":      &dynamodb.AttributeValue{S: aws.String(r.Id)},
@@ -148,7 +453,7 @@ func (r *Release) Save() error {
 		(*req.Item)["build"] = &dynamodb.AttributeValue{S: aws.String(r.Build)}
 	}
 
-	if r.Env != "" {
+	if r.Env != "" && key == "" {
 		(*req.Item)["env"] = &dynamodb.AttributeValue{S: aws.String(r.Env)}
 	}
 
@@ -164,6 +469,40 @@ func (r *Release) Save() error {
 
 	(*req.Item)["tasks"] = &dynamodb.AttributeValue{S: aws.String(string(tasks))}
 
+	if len(r.CanaryStep) > 0 {
+		step, err := json.Marshal(r.CanaryStep)
+
+		if err != nil {
+			return err
+		}
+
+		(*req.Item)["canary-step"] = &dynamodb.AttributeValue{S: aws.String(string(step))}
+	}
+
+	if len(r.CanaryService) > 0 {
+		service, err := json.Marshal(r.CanaryService)
+
+		if err != nil {
+			return err
+		}
+
+		(*req.Item)["canary-service"] = &dynamodb.AttributeValue{S: aws.String(string(service))}
+	}
+
+	if len(r.CanaryDecision) > 0 {
+		decision, err := json.Marshal(r.CanaryDecision)
+
+		if err != nil {
+			return err
+		}
+
+		(*req.Item)["canary-decision"] = &dynamodb.AttributeValue{S: aws.String(string(decision))}
+	}
+
+	if r.RolledBackFrom != "" {
+		(*req.Item)["rolled-back-from"] = &dynamodb.AttributeValue{S: aws.String(r.RolledBackFrom)}
+	}
+
 	_, err = DynamoDB().PutItem(req)
 
 	if err != nil {
@@ -173,7 +512,37 @@ func (r *Release) Save() error {
 	return nil
 }
 
-func (r *Release) Promote() error {
+// PromoteOptions controls how Promote drives the underlying CloudFormation
+// UpdateStack call.
+type PromoteOptions struct {
+	DisableRollback bool
+	OnFailure       string // "DO_NOTHING", "ROLLBACK", or "DELETE"
+}
+
+// StackEvent is a single CloudFormation stack event, as surfaced by
+// waitForStack and PromoteStream.
+type StackEvent struct {
+	Timestamp    time.Time
+	LogicalId    string
+	ResourceType string
+	Status       string
+	Reason       string
+}
+
+var stackTerminalStatus = map[string]bool{
+	"UPDATE_COMPLETE":          true,
+	"UPDATE_ROLLBACK_COMPLETE": true,
+	"UPDATE_ROLLBACK_FAILED":   true,
+	"UPDATE_FAILED":            true,
+}
+
+var stackFailedStatus = map[string]bool{
+	"UPDATE_ROLLBACK_COMPLETE": true,
+	"UPDATE_ROLLBACK_FAILED":   true,
+	"UPDATE_FAILED":            true,
+}
+
+func (r *Release) Promote(opts PromoteOptions) error {
 	formation, err := r.Formation()
 
 	if err != nil {
@@ -200,21 +569,362 @@ func (r *Release) Promote() error {
 		}
 	}
 
+	stackName := fmt.Sprintf("%s-%s", r.Cluster, r.App)
+
 	req := &cloudformation.UpdateStackInput{
-		StackName:    aws.String(fmt.Sprintf("%s-%s", r.Cluster, r.App)),
-		TemplateBody: aws.String(formation),
-		Parameters:   params,
+		StackName:       aws.String(stackName),
+		TemplateBody:    aws.String(formation),
+		Parameters:      params,
+		DisableRollback: aws.Boolean(opts.DisableRollback),
 	}
 
+	if opts.OnFailure != "" {
+		req.OnFailure = aws.String(opts.OnFailure)
+	}
+
+	since := time.Now()
+
 	_, err = CloudFormation().UpdateStack(req)
 
-	fmt.Printf("err %+v\n", err)
+	if err != nil {
+		return err
+	}
+
+	if err := r.waitForStack(stackName, since, nil); err != nil {
+		return err
+	}
+
+	return CurrentScheduler().Submit(context.Background(), r)
+}
+
+// PromoteStream behaves like Promote but returns a channel of stack events
+// as they happen, so a caller such as the web/API layer can surface a live
+// rollout log instead of only the final error.
+func (r *Release) PromoteStream(ctx context.Context, opts PromoteOptions) (<-chan StackEvent, <-chan error) {
+	events := make(chan StackEvent)
+	errs := make(chan error, 1)
+
+	go func() {
+		defer close(events)
+		defer close(errs)
+
+		formation, err := r.Formation()
+
+		if err != nil {
+			errs <- err
+			return
+		}
+
+		existing, err := formationParameters(formation)
+
+		if err != nil {
+			errs <- err
+			return
+		}
+
+		app, err := GetApp(r.Cluster, r.App)
+
+		if err != nil {
+			errs <- err
+			return
+		}
+
+		params := []*cloudformation.Parameter{}
+
+		for key, value := range app.Parameters {
+			if _, ok := existing[key]; ok {
+				params = append(params, &cloudformation.Parameter{ParameterKey: aws.String(key), ParameterValue: aws.String(value)})
+			}
+		}
+
+		stackName := fmt.Sprintf("%s-%s", r.Cluster, r.App)
+
+		req := &cloudformation.UpdateStackInput{
+			StackName:       aws.String(stackName),
+			TemplateBody:    aws.String(formation),
+			Parameters:      params,
+			DisableRollback: aws.Boolean(opts.DisableRollback),
+		}
+
+		if opts.OnFailure != "" {
+			req.OnFailure = aws.String(opts.OnFailure)
+		}
+
+		since := time.Now()
+
+		if _, err := CloudFormation().UpdateStack(req); err != nil {
+			errs <- err
+			return
+		}
+
+		if err := r.waitForStack(stackName, since, events); err != nil {
+			errs <- err
+			return
+		}
+
+		if err := CurrentScheduler().Submit(ctx, r); err != nil {
+			errs <- err
+		}
+	}()
+
+	return events, errs
+}
+
+// waitForStack polls DescribeStackEvents for stackName, forwarding every
+// event newer than since on out (if non-nil), until DescribeStacks reports a
+// terminal status. It returns an error if that terminal status is a
+// rollback or failure.
+func (r *Release) waitForStack(stackName string, since time.Time, out chan<- StackEvent) error {
+	for {
+		res, err := CloudFormation().DescribeStackEvents(&cloudformation.DescribeStackEventsInput{
+			StackName: aws.String(stackName),
+		})
+
+		if err != nil {
+			return err
+		}
+
+		// events come back newest-first; walk back to front so out receives
+		// them in chronological order
+		for i := len(res.StackEvents) - 1; i >= 0; i-- {
+			e := res.StackEvents[i]
+
+			if e.Timestamp == nil || !e.Timestamp.After(since) {
+				continue
+			}
+
+			if out != nil {
+				out <- StackEvent{
+					Timestamp:    *e.Timestamp,
+					LogicalId:    coalesceString(e.LogicalResourceId),
+					ResourceType: coalesceString(e.ResourceType),
+					Status:       coalesceString(e.ResourceStatus),
+					Reason:       coalesceString(e.ResourceStatusReason),
+				}
+			}
+
+			since = *e.Timestamp
+		}
+
+		sres, err := CloudFormation().DescribeStacks(&cloudformation.DescribeStacksInput{
+			StackName: aws.String(stackName),
+		})
+
+		if err != nil {
+			return err
+		}
+
+		if len(sres.Stacks) < 1 {
+			return fmt.Errorf("stack %s not found", stackName)
+		}
+
+		status := coalesceString(sres.Stacks[0].StackStatus)
+
+		if stackTerminalStatus[status] {
+			if stackFailedStatus[status] {
+				return fmt.Errorf("stack %s ended in %s", stackName, status)
+			}
+
+			return nil
+		}
+
+		time.Sleep(5 * time.Second)
+	}
+}
+
+func coalesceString(s *string) string {
+	if s == nil {
+		return ""
+	}
+
+	return *s
+}
+
+// PromoteCanary shifts traffic from each process's currently active service
+// to a new "green" service running r's task definitions, in steps, instead
+// of mutating the existing CloudFormation stack in place. Every backend
+// action -- standing up the canary, scaling it, checking its health,
+// promoting the primary service, tearing the canary down -- is delegated to
+// the current Scheduler through the optional CanaryScheduler interface, so
+// PromoteCanary itself stays free of any particular backend's SDK.
+//
+// Progress is tracked per process name (CanaryStep/CanaryService/
+// CanaryDecision) and is saved when the canary is first stood up (at step
+// 0) and again once a step is confirmed healthy -- never for a step still
+// in flight -- so that if r is already mid-rollout for a
+// process (CanaryService set and CanaryDecision still empty, as left
+// behind by a kernel that died mid-step) PromoteCanary can resume that
+// process from its last confirmed step instead of starting over, skipping
+// an unconfirmed one, or clobbering another process's progress. Use
+// AbortCanary instead to tear down an in-flight rollout found this way
+// rather than continuing it.
+func (r *Release) PromoteCanary(strategy CanaryStrategy) error {
+	if len(strategy.Steps) == 0 {
+		strategy.Steps = DefaultCanaryStrategy.Steps
+	}
+
+	if strategy.PollInterval == 0 {
+		strategy.PollInterval = DefaultCanaryStrategy.PollInterval
+	}
+
+	if strategy.StepTimeout == 0 {
+		strategy.StepTimeout = DefaultCanaryStrategy.StepTimeout
+	}
+
+	scheduler, ok := CurrentScheduler().(CanaryScheduler)
+
+	if !ok {
+		return fmt.Errorf("canary rollouts are not supported by the current scheduler")
+	}
+
+	pss, err := r.ProcessSpecs()
+
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	for _, ps := range pss {
+		primary := fmt.Sprintf("%s-%s-%s", r.Cluster, r.App, ps.Name)
+		canary := fmt.Sprintf("%s-%s-%s-canary", r.Cluster, r.App, ps.Name)
+
+		resuming := r.CanaryService[ps.Name] == canary && r.CanaryDecision[ps.Name] == ""
+
+		if resuming {
+			fmt.Printf("resuming canary %s at step %d\n", canary, r.CanaryStep[ps.Name])
+		} else {
+			r.setCanaryService(ps.Name, canary)
+			r.setCanaryStep(ps.Name, 0)
+			r.setCanaryDecision(ps.Name, "")
+
+			if err := scheduler.SubmitCanary(ctx, r, ps, canary); err != nil {
+				scheduler.RemoveCanary(ctx, r, canary)
+				return err
+			}
+
+			if err := r.persist(); err != nil {
+				scheduler.RemoveCanary(ctx, r, canary)
+				return err
+			}
+		}
+
+		for _, pct := range strategy.Steps {
+			if resuming && pct <= r.CanaryStep[ps.Name] {
+				continue
+			}
+
+			desired := int64(ps.Count) * int64(pct) / 100
+
+			if err := r.waitForCanaryStep(scheduler, ctx, canary, desired, strategy); err != nil {
+				r.setCanaryDecision(ps.Name, "rollback")
+				r.persist()
+				scheduler.RemoveCanary(ctx, r, canary)
+				return err
+			}
+
+			// Only record the step as done once waitForCanaryStep has
+			// confirmed it healthy -- if the kernel dies mid-step, a
+			// resumed rollout must re-confirm it rather than skip it.
+			r.setCanaryStep(ps.Name, pct)
+
+			if err := r.persist(); err != nil {
+				return err
+			}
+		}
+
+		r.setCanaryDecision(ps.Name, "promoted")
+
+		if err := r.persist(); err != nil {
+			return err
+		}
+
+		if err := scheduler.PromoteService(ctx, r, primary, r.Tasks[ps.Name], int64(ps.Count)); err != nil {
+			return err
+		}
+
+		scheduler.RemoveCanary(ctx, r, canary)
+	}
+
+	return nil
+}
+
+// waitForCanaryStep scales canary to desired through scheduler and polls
+// CanaryHealthy until it reports healthy or the step times out. The
+// poll/timeout loop lives here rather than behind CanaryScheduler so every
+// backend gets the same health-gating behavior without reimplementing it.
+func (r *Release) waitForCanaryStep(scheduler CanaryScheduler, ctx context.Context, canary string, desired int64, strategy CanaryStrategy) error {
+	if err := scheduler.ScaleCanary(ctx, r, canary, desired); err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(strategy.StepTimeout)
+
+	for time.Now().Before(deadline) {
+		healthy, err := scheduler.CanaryHealthy(ctx, r, canary, desired)
+
+		if err != nil {
+			return err
+		}
+
+		if healthy {
+			return nil
+		}
+
+		time.Sleep(strategy.PollInterval)
+	}
+
+	return fmt.Errorf("canary step to %d timed out", desired)
+}
+
+func (r *Release) setCanaryStep(process string, step int) {
+	if r.CanaryStep == nil {
+		r.CanaryStep = map[string]int{}
+	}
+
+	r.CanaryStep[process] = step
+}
+
+func (r *Release) setCanaryService(process, service string) {
+	if r.CanaryService == nil {
+		r.CanaryService = map[string]string{}
+	}
+
+	r.CanaryService[process] = service
+}
 
-	// TODO: wait for stack
+func (r *Release) setCanaryDecision(process, decision string) {
+	if r.CanaryDecision == nil {
+		r.CanaryDecision = map[string]string{}
+	}
+
+	r.CanaryDecision[process] = decision
+}
 
-	r.registerServices()
+// AbortCanary tears down the in-flight canary rollout found on r for
+// process -- as left behind by a kernel that died before PromoteCanary
+// reached a terminal CanaryDecision for it -- without resuming it. The
+// primary service is left untouched at its last known-good count.
+func (r *Release) AbortCanary(process string) error {
+	canary := r.CanaryService[process]
 
-	return err
+	if canary == "" {
+		return nil
+	}
+
+	scheduler, ok := CurrentScheduler().(CanaryScheduler)
+
+	if !ok {
+		return fmt.Errorf("canary rollouts are not supported by the current scheduler")
+	}
+
+	scheduler.RemoveCanary(context.Background(), r, canary)
+
+	r.setCanaryDecision(process, "aborted")
+	r.setCanaryService(process, "")
+	r.setCanaryStep(process, 0)
+
+	return r.persist()
 }
 
 func (r *Release) Formation() (string, error) {
@@ -264,122 +974,116 @@ func (r *Release) Services() (Services, error) {
 	return services, nil
 }
 
-func (r *Release) registerServices() error {
-	app, err := GetApp(r.Cluster, r.App)
 
-	if err != nil {
-		return err
-	}
+// envEnvelope is the ciphertext blob persisted in S3 for a KMS-protected
+// release environment: a per-release data key encrypted under the app's
+// KMS key, alongside the env itself encrypted under that data key.
+type envEnvelope struct {
+	Key   []byte `json:"key"`
+	Nonce []byte `json:"nonce"`
+	Data  []byte `json:"data"`
+}
+
+func envCiphertextKey(id string) string {
+	return fmt.Sprintf("releases/%s/env.enc", id)
+}
 
-	pss, err := r.Processes()
+// encryptEnvironment generates a fresh data key under keyArn and uses it to
+// encrypt r.Env, returning the envelope to be persisted to S3.
+func (r *Release) encryptEnvironment(keyArn string) ([]byte, error) {
+	gres, err := KMS().GenerateDataKey(&kms.GenerateDataKeyInput{
+		KeyId:   aws.String(keyArn),
+		KeySpec: aws.String("AES_256"),
+	})
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	for _, ps := range pss {
-		gres, err := ECS().DescribeServices(&ecs.DescribeServicesInput{
-			Cluster:  aws.String(r.Cluster),
-			Services: []*string{aws.String(fmt.Sprintf("%s-%s-%s", r.Cluster, r.App, ps.Name))},
-		})
-
-		if err != nil {
-			return err
-		}
+	return sealEnvironment(gres.Plaintext, gres.CiphertextBlob, r.Env)
+}
 
-		fmt.Printf("r.Tasks %+v\n", r.Tasks)
+// sealEnvironment AES-GCM-seals env under dataKey, wrapping the result in an
+// envelope alongside ciphertextKey (dataKey's own KMS-encrypted form, opaque
+// here) so decryptEnvironment can later recover dataKey through KMS. It's
+// split out from encryptEnvironment so the seal/open round trip can be unit
+// tested without a KMS call.
+func sealEnvironment(dataKey, ciphertextKey []byte, env string) ([]byte, error) {
+	block, err := aes.NewCipher(dataKey)
 
-		if len(gres.Services) < 1 {
-			creq := &ecs.CreateServiceInput{
-				Cluster:        aws.String(r.Cluster),
-				DesiredCount:   aws.Long(int64(ps.Count)),
-				Role:           aws.String("arn:aws:iam::778743527532:role/ecsServiceRole"),
-				ServiceName:    aws.String(fmt.Sprintf("%s-%s-%s", r.Cluster, r.App, ps.Name)),
-				TaskDefinition: aws.String(r.Tasks[ps.Name]),
-			}
+	if err != nil {
+		return nil, err
+	}
 
-			for _, port := range ps.Ports {
-				fmt.Printf("port %+v\n", port)
-				creq.LoadBalancers = append(creq.LoadBalancers, &ecs.LoadBalancer{
-					ContainerName:    aws.String("main"),
-					ContainerPort:    aws.Long(int64(port)),
-					LoadBalancerName: aws.String(app.Outputs["Balancer"]),
-				})
-			}
+	gcm, err := cipher.NewGCM(block)
 
-			cres, err := ECS().CreateService(creq)
+	if err != nil {
+		return nil, err
+	}
 
-			fmt.Printf("cres %+v\n", cres)
-			fmt.Printf("err %+v\n", err)
-		} else {
-		}
+	nonce := make([]byte, gcm.NonceSize())
 
-		fmt.Printf("gres %+v\n", gres)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
 	}
 
-	return nil
+	data := gcm.Seal(nil, nonce, []byte(env), nil)
+
+	return json.Marshal(envEnvelope{
+		Key:   ciphertextKey,
+		Nonce: nonce,
+		Data:  data,
+	})
 }
 
-func (r *Release) registerTasks() error {
-	tasks := map[string]string{}
+// decryptEnvironment unwraps an envelope produced by encryptEnvironment,
+// decrypting the data key through KMS and then the env with that key.
+func (r *Release) decryptEnvironment(keyArn string, blob []byte) (Environment, error) {
+	var envelope envEnvelope
+
+	if err := json.Unmarshal(blob, &envelope); err != nil {
+		return nil, err
+	}
 
-	pss, err := r.Processes()
+	dataKey, err := crypt.New(os.Getenv("AWS_REGION"), os.Getenv("AWS_ACCESS"), os.Getenv("AWS_SECRET")).Decrypt(keyArn, envelope.Key)
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	for _, ps := range pss {
-		build, err := GetBuild(r.Cluster, r.App, r.Build)
-
-		req := &ecs.RegisterTaskDefinitionInput{
-			ContainerDefinitions: []*ecs.ContainerDefinition{
-				{
-					CPU:       aws.Long(200),
-					Essential: aws.Boolean(true),
-					Image:     aws.String(build.Image(ps.Name)),
-					Memory:    aws.Long(300),
-					Name:      aws.String("main"),
-				},
-			},
-			Family: aws.String(fmt.Sprintf("%s-%s-%s", r.Cluster, r.App, ps.Name)),
-		}
-
-		if ps.Command != "" {
-			req.ContainerDefinitions[0].Command = []*string{aws.String("sh"), aws.String("-c"), aws.String(ps.Command)}
-		}
+	return openEnvironment(dataKey, blob)
+}
 
-		// set environment
-		env := LoadEnvironment([]byte(r.Env))
+// openEnvironment decrypts an envelope produced by sealEnvironment given the
+// already-recovered dataKey, without going through KMS itself. It's split
+// out from decryptEnvironment so the seal/open round trip can be unit
+// tested without a KMS call.
+func openEnvironment(dataKey, blob []byte) (Environment, error) {
+	var envelope envEnvelope
 
-		for key, val := range env {
-			req.ContainerDefinitions[0].Environment = append(req.ContainerDefinitions[0].Environment, &ecs.KeyValuePair{
-				Name:  aws.String(key),
-				Value: aws.String(val),
-			})
-		}
+	if err := json.Unmarshal(blob, &envelope); err != nil {
+		return nil, err
+	}
 
-		// set portmappings
-		// TODO: fix base port
-		for i, p := range ps.Ports {
-			req.ContainerDefinitions[0].PortMappings = append(req.ContainerDefinitions[0].PortMappings, &ecs.PortMapping{
-				ContainerPort: aws.Long(int64(p)),
-				HostPort:      aws.Long(int64(8000 + i)),
-			})
-		}
+	block, err := aes.NewCipher(dataKey)
 
-		res, err := ECS().RegisterTaskDefinition(req)
+	if err != nil {
+		return nil, err
+	}
 
-		if err != nil {
-			return err
-		}
+	gcm, err := cipher.NewGCM(block)
 
-		tasks[ps.Name] = fmt.Sprintf("%s:%d", *res.TaskDefinition.Family, *res.TaskDefinition.Revision)
+	if err != nil {
+		return nil, err
 	}
 
-	r.Tasks = tasks
+	data, err := gcm.Open(nil, envelope.Nonce, envelope.Data, nil)
 
-	return nil
+	if err != nil {
+		return nil, err
+	}
+
+	return LoadEnvironment(data), nil
 }
 
 func releasesTable(cluster, app string) string {
@@ -403,5 +1107,19 @@ func releaseFromItem(item map[string]*dynamodb.AttributeValue) *Release {
 	json.Unmarshal([]byte(coalesce(item["tasks"], "{}")), &tasks)
 	release.Tasks = tasks
 
+	var step map[string]int
+	json.Unmarshal([]byte(coalesce(item["canary-step"], "{}")), &step)
+	release.CanaryStep = step
+
+	var service map[string]string
+	json.Unmarshal([]byte(coalesce(item["canary-service"], "{}")), &service)
+	release.CanaryService = service
+
+	var decision map[string]string
+	json.Unmarshal([]byte(coalesce(item["canary-decision"], "{}")), &decision)
+	release.CanaryDecision = decision
+
+	release.RolledBackFrom = coalesce(item["rolled-back-from"], "")
+
 	return release
 }
@@ -0,0 +1,149 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStackTerminalStatus(t *testing.T) {
+	cases := []struct {
+		status   string
+		terminal bool
+		failed   bool
+	}{
+		{"UPDATE_IN_PROGRESS", false, false},
+		{"UPDATE_COMPLETE", true, false},
+		{"UPDATE_ROLLBACK_IN_PROGRESS", false, false},
+		{"UPDATE_ROLLBACK_COMPLETE", true, true},
+		{"UPDATE_ROLLBACK_FAILED", true, true},
+		{"UPDATE_FAILED", true, true},
+	}
+
+	for _, c := range cases {
+		if got := stackTerminalStatus[c.status]; got != c.terminal {
+			t.Errorf("stackTerminalStatus[%s] = %v, want %v", c.status, got, c.terminal)
+		}
+
+		if got := stackFailedStatus[c.status]; got != c.failed {
+			t.Errorf("stackFailedStatus[%s] = %v, want %v", c.status, got, c.failed)
+		}
+	}
+}
+
+func TestSelectPrevious(t *testing.T) {
+	now := time.Now()
+
+	releases := Releases{
+		{Id: "R3", Active: true, Created: now},
+		{Id: "R2", Active: false, Created: now.Add(-1 * time.Minute)},
+		{Id: "R1", Active: false, Created: now.Add(-2 * time.Minute)},
+	}
+
+	previous := selectPrevious(releases, now)
+
+	if previous == nil || previous.Id != "R2" {
+		t.Fatalf("selectPrevious = %+v, want R2", previous)
+	}
+}
+
+func TestSelectPreviousSkipsActiveAndNewer(t *testing.T) {
+	now := time.Now()
+
+	releases := Releases{
+		{Id: "R2", Active: true, Created: now.Add(-1 * time.Minute)},
+		{Id: "R1", Active: false, Created: now.Add(-2 * time.Minute)},
+	}
+
+	previous := selectPrevious(releases, now.Add(-90*time.Second))
+
+	if previous == nil || previous.Id != "R1" {
+		t.Fatalf("selectPrevious = %+v, want R1", previous)
+	}
+}
+
+func TestSelectPreviousNoMatch(t *testing.T) {
+	releases := Releases{
+		{Id: "R1", Active: true, Created: time.Now()},
+	}
+
+	if previous := selectPrevious(releases, time.Now()); previous != nil {
+		t.Fatalf("selectPrevious = %+v, want nil", previous)
+	}
+}
+
+func TestDiffEnvironment(t *testing.T) {
+	env := Environment{"A": "1", "B": "2"}
+	oenv := Environment{"B": "3", "C": "4"}
+
+	added, removed, changed := diffEnvironment(env, oenv)
+
+	if added["C"] != "4" {
+		t.Errorf("added[C] = %q, want 4", added["C"])
+	}
+
+	if removed["A"] != "1" {
+		t.Errorf("removed[A] = %q, want 1", removed["A"])
+	}
+
+	if changed["B"] != (EnvDiff{From: "2", To: "3"}) {
+		t.Errorf("changed[B] = %+v, want {2 3}", changed["B"])
+	}
+}
+
+func TestDiffProcessSpecs(t *testing.T) {
+	specs := []ProcessSpec{
+		{Name: "web", Image: "app:1", Command: ""},
+		{Name: "worker", Image: "app:1", Command: "work"},
+	}
+
+	ospecs := []ProcessSpec{
+		{Name: "web", Image: "app:2", Command: ""},
+		{Name: "worker", Image: "app:1", Command: "work"},
+	}
+
+	diffs := diffProcessSpecs(specs, ospecs)
+
+	if len(diffs) != 1 {
+		t.Fatalf("len(diffs) = %d, want 1", len(diffs))
+	}
+
+	if diffs[0].Name != "web" || diffs[0].FromImage != "app:1" || diffs[0].ToImage != "app:2" {
+		t.Errorf("diffs[0] = %+v", diffs[0])
+	}
+}
+
+func TestSealOpenEnvironmentRoundTrip(t *testing.T) {
+	dataKey := make([]byte, 32)
+
+	blob, err := sealEnvironment(dataKey, []byte("ciphertext-blob"), "FOO=bar")
+
+	if err != nil {
+		t.Fatalf("sealEnvironment: %v", err)
+	}
+
+	env, err := openEnvironment(dataKey, blob)
+
+	if err != nil {
+		t.Fatalf("openEnvironment: %v", err)
+	}
+
+	if env["FOO"] != "bar" {
+		t.Errorf("env[FOO] = %q, want bar", env["FOO"])
+	}
+}
+
+func TestOpenEnvironmentWrongKeyFails(t *testing.T) {
+	dataKey := make([]byte, 32)
+	wrongKey := make([]byte, 32)
+	wrongKey[0] = 1
+
+	blob, err := sealEnvironment(dataKey, []byte("ciphertext-blob"), "FOO=bar")
+
+	if err != nil {
+		t.Fatalf("sealEnvironment: %v", err)
+	}
+
+	if _, err := openEnvironment(wrongKey, blob); err == nil {
+		t.Fatalf("openEnvironment with wrong key = nil error, want failure")
+	}
+}
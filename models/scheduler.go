@@ -0,0 +1,136 @@
+package models
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/convox/kernel/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// Instance is a single running unit of a process, as reported by whatever
+// Scheduler placed it.
+type Instance struct {
+	Id      string
+	Process string
+	Status  string
+	Started time.Time
+}
+
+// ProcessSpec is the scheduler-agnostic description of a process that a
+// Release requires. It is derived once from a Release's manifest and build
+// so that individual Scheduler implementations don't each have to re-parse
+// LoadManifest.
+type ProcessSpec struct {
+	Name    string
+	Image   string
+	Command string
+	Env     Environment
+	Ports   []int
+	Count   int
+	Health  string
+}
+
+// Scheduler decouples Release from any particular backend (ECS,
+// Kubernetes, local docker, ...). Implementations live in their own
+// packages, e.g. the ecs package under scheduler/ecs, and are wired up at
+// startup with SetScheduler.
+type Scheduler interface {
+	Submit(ctx context.Context, r *Release) error
+	Remove(ctx context.Context, r *Release) error
+	Instances(ctx context.Context, r *Release) ([]Instance, error)
+	Tail(ctx context.Context, r *Release, out io.Writer) error
+}
+
+// CanaryScheduler is implemented by Scheduler backends that support
+// health-gated canary rollouts (see Release.PromoteCanary). It stays a
+// separate, optional interface rather than growing Scheduler itself so
+// backends with no notion of a parallel "green" service (or that aren't
+// ready to implement one yet) can still satisfy plain Scheduler.
+//
+// Release.PromoteCanary/AbortCanary drive the poll/timeout loop and persist
+// progress themselves; everything backend-specific -- standing up the
+// canary, scaling it, checking its health, promoting the primary service,
+// tearing the canary down -- lives behind these methods so models stays
+// free of any particular scheduler's SDK types.
+type CanaryScheduler interface {
+	Scheduler
+
+	// SubmitCanary stands up a canary service for spec at r's current task
+	// definition for spec.Name, starting at zero desired count.
+	SubmitCanary(ctx context.Context, r *Release, spec ProcessSpec, canary string) error
+
+	// ScaleCanary sets canary's desired count.
+	ScaleCanary(ctx context.Context, r *Release, canary string, desired int64) error
+
+	// CanaryHealthy reports whether canary is running at desired count with
+	// no unhealthy hosts behind it.
+	CanaryHealthy(ctx context.Context, r *Release, canary string, desired int64) (bool, error)
+
+	// PromoteService updates service to taskDefinition at desired count,
+	// used to roll a confirmed canary onto the primary service.
+	PromoteService(ctx context.Context, r *Release, service, taskDefinition string, desired int64) error
+
+	// RemoveCanary tears down canary regardless of its current state. It
+	// logs rather than returns errors, since callers use it on both
+	// success and failure paths and a teardown failure shouldn't mask the
+	// error that triggered it.
+	RemoveCanary(ctx context.Context, r *Release, canary string)
+}
+
+var scheduler Scheduler
+
+// SetScheduler installs the Scheduler implementation that Release will use.
+// It's called once at startup by whatever wires up the process (the ecs
+// implementation today; a kubernetes or docker implementation could be
+// selected the same way).
+func SetScheduler(s Scheduler) {
+	scheduler = s
+}
+
+// CurrentScheduler returns the Scheduler installed with SetScheduler.
+func CurrentScheduler() Scheduler {
+	return scheduler
+}
+
+// ProcessSpecs builds the ProcessSpec intermediate for every process in r's
+// manifest, resolving the build image and decrypted environment once so
+// that Scheduler implementations don't each have to do it themselves.
+func (r *Release) ProcessSpecs() ([]ProcessSpec, error) {
+	pss, err := r.Processes()
+
+	if err != nil {
+		return nil, err
+	}
+
+	build, err := GetBuild(r.Cluster, r.App, r.Build)
+
+	if err != nil {
+		return nil, err
+	}
+
+	env, err := r.Environment()
+
+	if err != nil {
+		return nil, err
+	}
+
+	specs := make([]ProcessSpec, len(pss))
+
+	for i, ps := range pss {
+		specs[i] = ProcessSpec{
+			Name:    ps.Name,
+			Image:   build.Image(ps.Name),
+			Command: ps.Command,
+			Env:     env,
+			Ports:   ps.Ports,
+			Count:   ps.Count,
+		}
+	}
+
+	return specs, nil
+}
+
+func (s ProcessSpec) String() string {
+	return fmt.Sprintf("%s (%s)", s.Name, s.Image)
+}
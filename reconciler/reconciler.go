@@ -0,0 +1,299 @@
+// Package reconciler continuously re-asserts the ECS state declared by each
+// app's active Release, correcting drift from manual ECS edits the same
+// way Promote would: by resubmitting the release through the scheduler.
+package reconciler
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/convox/kernel/Godeps/_workspace/src/github.com/awslabs/aws-sdk-go/aws"
+	"github.com/convox/kernel/Godeps/_workspace/src/github.com/awslabs/aws-sdk-go/service/dynamodb"
+	"github.com/convox/kernel/Godeps/_workspace/src/github.com/awslabs/aws-sdk-go/service/ecs"
+	"github.com/convox/kernel/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/convox/kernel/models"
+)
+
+// DefaultInterval is how often a Reconciler reconciles each app when none is
+// given to New.
+const DefaultInterval = 60 * time.Second
+
+var (
+	reconcileTotal       int64
+	reconcileErrorsTotal int64
+
+	driftDetectedTotal   = map[string]int64{}
+	driftDetectedTotalMu sync.Mutex
+)
+
+// Metrics is a point-in-time snapshot of the reconciler's Prometheus-style
+// counters: reconcile_total, reconcile_errors_total, and
+// drift_detected_total broken out by kind.
+type Metrics struct {
+	ReconcileTotal       int64
+	ReconcileErrorsTotal int64
+	DriftDetectedTotal   map[string]int64
+}
+
+// Snapshot returns the current counter values.
+func Snapshot() Metrics {
+	driftDetectedTotalMu.Lock()
+	defer driftDetectedTotalMu.Unlock()
+
+	drift := make(map[string]int64, len(driftDetectedTotal))
+
+	for kind, count := range driftDetectedTotal {
+		drift[kind] = count
+	}
+
+	return Metrics{
+		ReconcileTotal:       atomic.LoadInt64(&reconcileTotal),
+		ReconcileErrorsTotal: atomic.LoadInt64(&reconcileErrorsTotal),
+		DriftDetectedTotal:   drift,
+	}
+}
+
+func incDrift(kind string) {
+	driftDetectedTotalMu.Lock()
+	defer driftDetectedTotalMu.Unlock()
+	driftDetectedTotal[kind]++
+}
+
+// Reconciler periodically diffs a cluster's actual ECS state against what
+// each app's active Release declares, and resubmits the release through the
+// scheduler whenever it finds drift.
+type Reconciler struct {
+	Cluster  string
+	Interval time.Duration
+}
+
+// New returns a Reconciler for cluster, reconciling every interval. A zero
+// interval falls back to DefaultInterval.
+func New(cluster string, interval time.Duration) *Reconciler {
+	if interval == 0 {
+		interval = DefaultInterval
+	}
+
+	return &Reconciler{Cluster: cluster, Interval: interval}
+}
+
+// Run reconciles rc.Cluster once immediately, then every rc.Interval until
+// ctx is done.
+func (rc *Reconciler) Run(ctx context.Context) {
+	ticker := time.NewTicker(rc.Interval)
+	defer ticker.Stop()
+
+	for {
+		rc.reconcileOnce(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (rc *Reconciler) reconcileOnce(ctx context.Context) {
+	atomic.AddInt64(&reconcileTotal, 1)
+
+	apps, err := models.ListApps(rc.Cluster)
+
+	if err != nil {
+		atomic.AddInt64(&reconcileErrorsTotal, 1)
+		fmt.Printf("err %+v\n", err)
+		return
+	}
+
+	for _, app := range apps {
+		if err := rc.reconcileApp(ctx, app); err != nil {
+			atomic.AddInt64(&reconcileErrorsTotal, 1)
+			fmt.Printf("err %+v\n", err)
+		}
+	}
+}
+
+func (rc *Reconciler) reconcileApp(ctx context.Context, app models.App) error {
+	if app.Release == "" {
+		return nil
+	}
+
+	locked, err := rc.acquireLease(app.Name)
+
+	if err != nil {
+		return err
+	}
+
+	if !locked {
+		return nil
+	}
+
+	defer rc.releaseLease(app.Name)
+
+	release, err := models.GetRelease(rc.Cluster, app.Name, app.Release)
+
+	if err != nil {
+		return err
+	}
+
+	specs, err := release.ProcessSpecs()
+
+	if err != nil {
+		return err
+	}
+
+	drifted := false
+
+	for _, spec := range specs {
+		kind, ok, err := rc.diffService(app, release, spec)
+
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			incDrift(kind)
+			drifted = true
+		}
+	}
+
+	if !drifted {
+		return nil
+	}
+
+	return models.CurrentScheduler().Submit(ctx, release)
+}
+
+// diffService compares one process's declared spec against its live ECS
+// service, returning the kind of drift found (if any) and whether the
+// service currently matches.
+func (rc *Reconciler) diffService(app models.App, release *models.Release, spec models.ProcessSpec) (string, bool, error) {
+	name := fmt.Sprintf("%s-%s-%s", rc.Cluster, app.Name, spec.Name)
+
+	res, err := models.ECS().DescribeServices(&ecs.DescribeServicesInput{
+		Cluster:  aws.String(rc.Cluster),
+		Services: []*string{aws.String(name)},
+	})
+
+	if err != nil {
+		return "", false, err
+	}
+
+	if len(res.Services) < 1 {
+		return "missing-service", false, nil
+	}
+
+	svc := res.Services[0]
+
+	kind := driftKind(spec, release.Tasks[spec.Name], svc.DesiredCount, svc.TaskDefinition, len(svc.LoadBalancers))
+
+	return kind, kind == "", nil
+}
+
+// driftKind compares a process's declared spec against the live values read
+// off its ECS service and reports which kind of drift (if any) it finds. It
+// takes plain values rather than an *ecs.Service so it can be unit tested
+// without a live ECS call.
+func driftKind(spec models.ProcessSpec, wantTaskDefinition string, desiredCount *int64, taskDefinition *string, loadBalancerCount int) string {
+	if desiredCount == nil || *desiredCount != int64(spec.Count) {
+		return "desired-count"
+	}
+
+	if taskDefinition == nil || *taskDefinition != wantTaskDefinition {
+		return "task-definition"
+	}
+
+	if loadBalancerCount != len(spec.Ports) {
+		return "load-balancer"
+	}
+
+	return ""
+}
+
+// acquireLease takes a per-app leader lock for the duration of a single
+// tick: a conditional put of a reconcile-lease item that either doesn't
+// exist yet, or whose TTL ("expires") has already passed, so a replica that
+// died mid-tick doesn't wedge the lock forever. reconcileApp releases the
+// lease itself via releaseLease once the tick finishes, so the lock is held
+// per-tick rather than permanently.
+func (rc *Reconciler) acquireLease(app string) (bool, error) {
+	now := time.Now()
+
+	item := &map[string]*dynamodb.AttributeValue{
+		"id":      &dynamodb.AttributeValue{S: aws.String(rc.leaseId(app))},
+		"expires": &dynamodb.AttributeValue{N: aws.String(fmt.Sprintf("%d", now.Add(rc.Interval).Unix()))},
+	}
+
+	_, err := models.DynamoDB().PutItem(&dynamodb.PutItemInput{
+		Item:      item,
+		TableName: aws.String(leasesTable(rc.Cluster)),
+		Expected: &map[string]*dynamodb.ExpectedAttributeValue{
+			"id": &dynamodb.ExpectedAttributeValue{Exists: aws.Boolean(false)},
+		},
+	})
+
+	if err == nil {
+		return true, nil
+	}
+
+	if !isConditionalCheckFailed(err) {
+		return false, err
+	}
+
+	// a lease already exists, but it might be a stale one left behind by a
+	// replica that never got to releaseLease -- take it over if its TTL has
+	// already passed.
+	_, err = models.DynamoDB().PutItem(&dynamodb.PutItemInput{
+		Item:      item,
+		TableName: aws.String(leasesTable(rc.Cluster)),
+		Expected: &map[string]*dynamodb.ExpectedAttributeValue{
+			"expires": &dynamodb.ExpectedAttributeValue{
+				ComparisonOperator: aws.String("LT"),
+				AttributeValueList: []*dynamodb.AttributeValue{
+					&dynamodb.AttributeValue{N: aws.String(fmt.Sprintf("%d", now.Unix()))},
+				},
+			},
+		},
+	})
+
+	if err != nil {
+		if isConditionalCheckFailed(err) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	return true, nil
+}
+
+// releaseLease frees the per-app lock acquired by acquireLease so the next
+// tick -- on this replica or another -- can take it immediately instead of
+// waiting out the TTL.
+func (rc *Reconciler) releaseLease(app string) {
+	_, err := models.DynamoDB().DeleteItem(&dynamodb.DeleteItemInput{
+		Key: &map[string]*dynamodb.AttributeValue{
+			"id": &dynamodb.AttributeValue{S: aws.String(rc.leaseId(app))},
+		},
+		TableName: aws.String(leasesTable(rc.Cluster)),
+	})
+
+	if err != nil {
+		fmt.Printf("err %+v\n", err)
+	}
+}
+
+func (rc *Reconciler) leaseId(app string) string {
+	return fmt.Sprintf("%s-%s-reconcile-lease", rc.Cluster, app)
+}
+
+func leasesTable(cluster string) string {
+	return fmt.Sprintf("%s-leases", cluster)
+}
+
+func isConditionalCheckFailed(err error) bool {
+	return strings.Contains(err.Error(), "ConditionalCheckFailed")
+}
@@ -0,0 +1,55 @@
+package reconciler
+
+import (
+	"testing"
+
+	"github.com/convox/kernel/models"
+)
+
+func int64p(i int64) *int64 {
+	return &i
+}
+
+func stringp(s string) *string {
+	return &s
+}
+
+func TestDriftKindNoDrift(t *testing.T) {
+	spec := models.ProcessSpec{Count: 2, Ports: []int{80}}
+
+	if kind := driftKind(spec, "app:1", int64p(2), stringp("app:1"), 1); kind != "" {
+		t.Errorf("driftKind = %q, want none", kind)
+	}
+}
+
+func TestDriftKindDesiredCount(t *testing.T) {
+	spec := models.ProcessSpec{Count: 3, Ports: []int{80}}
+
+	if kind := driftKind(spec, "app:1", int64p(2), stringp("app:1"), 1); kind != "desired-count" {
+		t.Errorf("driftKind = %q, want desired-count", kind)
+	}
+
+	if kind := driftKind(spec, "app:1", nil, stringp("app:1"), 1); kind != "desired-count" {
+		t.Errorf("driftKind = %q, want desired-count", kind)
+	}
+}
+
+func TestDriftKindTaskDefinition(t *testing.T) {
+	spec := models.ProcessSpec{Count: 2, Ports: []int{80}}
+
+	if kind := driftKind(spec, "app:2", int64p(2), stringp("app:1"), 1); kind != "task-definition" {
+		t.Errorf("driftKind = %q, want task-definition", kind)
+	}
+
+	if kind := driftKind(spec, "app:1", int64p(2), nil, 1); kind != "task-definition" {
+		t.Errorf("driftKind = %q, want task-definition", kind)
+	}
+}
+
+func TestDriftKindLoadBalancer(t *testing.T) {
+	spec := models.ProcessSpec{Count: 2, Ports: []int{80, 443}}
+
+	if kind := driftKind(spec, "app:1", int64p(2), stringp("app:1"), 1); kind != "load-balancer" {
+		t.Errorf("driftKind = %q, want load-balancer", kind)
+	}
+}
@@ -0,0 +1,422 @@
+// Package ecs implements models.Scheduler (and models.CanaryScheduler) on
+// top of Amazon ECS. It holds the task-definition, service registration and
+// canary rollout logic that used to live directly on models.Release, so
+// that other backends (kubernetes, a local docker scheduler for dev) can be
+// swapped in behind the same interfaces.
+package ecs
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/convox/kernel/Godeps/_workspace/src/github.com/awslabs/aws-sdk-go/aws"
+	"github.com/convox/kernel/Godeps/_workspace/src/github.com/awslabs/aws-sdk-go/service/ecs"
+	"github.com/convox/kernel/Godeps/_workspace/src/github.com/awslabs/aws-sdk-go/service/elb"
+	"github.com/convox/kernel/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/convox/kernel/models"
+)
+
+// Scheduler is the ECS-backed models.Scheduler implementation.
+type Scheduler struct{}
+
+// New returns an ECS-backed Scheduler.
+func New() *Scheduler {
+	return &Scheduler{}
+}
+
+// Submit registers task definitions for every process in r and brings each
+// process's ECS service up to match, creating it if it doesn't exist yet.
+func (s *Scheduler) Submit(ctx context.Context, r *models.Release) error {
+	specs, err := r.ProcessSpecs()
+
+	if err != nil {
+		return err
+	}
+
+	app, err := models.GetApp(r.Cluster, r.App)
+
+	if err != nil {
+		return err
+	}
+
+	tasks := map[string]string{}
+
+	for _, spec := range specs {
+		arn, err := s.registerTaskDefinition(r, spec)
+
+		if err != nil {
+			return err
+		}
+
+		tasks[spec.Name] = arn
+	}
+
+	r.Tasks = tasks
+
+	for _, spec := range specs {
+		if err := s.submitService(r, app, spec); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Scheduler) registerTaskDefinition(r *models.Release, spec models.ProcessSpec) (string, error) {
+	req := &ecs.RegisterTaskDefinitionInput{
+		ContainerDefinitions: []*ecs.ContainerDefinition{
+			{
+				CPU:       aws.Long(200),
+				Essential: aws.Boolean(true),
+				Image:     aws.String(spec.Image),
+				Memory:    aws.Long(300),
+				Name:      aws.String("main"),
+			},
+		},
+		Family: aws.String(s.family(r, spec.Name)),
+	}
+
+	if spec.Command != "" {
+		req.ContainerDefinitions[0].Command = []*string{aws.String("sh"), aws.String("-c"), aws.String(spec.Command)}
+	}
+
+	for key, val := range spec.Env {
+		req.ContainerDefinitions[0].Environment = append(req.ContainerDefinitions[0].Environment, &ecs.KeyValuePair{
+			Name:  aws.String(key),
+			Value: aws.String(val),
+		})
+	}
+
+	// TODO: fix base port
+	for i, p := range spec.Ports {
+		req.ContainerDefinitions[0].PortMappings = append(req.ContainerDefinitions[0].PortMappings, &ecs.PortMapping{
+			ContainerPort: aws.Long(int64(p)),
+			HostPort:      aws.Long(int64(8000 + i)),
+		})
+	}
+
+	res, err := models.ECS().RegisterTaskDefinition(req)
+
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s:%d", *res.TaskDefinition.Family, *res.TaskDefinition.Revision), nil
+}
+
+func (s *Scheduler) submitService(r *models.Release, app *models.App, spec models.ProcessSpec) error {
+	name := s.serviceName(r, spec.Name)
+
+	gres, err := models.ECS().DescribeServices(&ecs.DescribeServicesInput{
+		Cluster:  aws.String(r.Cluster),
+		Services: []*string{aws.String(name)},
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if len(gres.Services) < 1 {
+		creq := &ecs.CreateServiceInput{
+			Cluster:        aws.String(r.Cluster),
+			DesiredCount:   aws.Long(int64(spec.Count)),
+			Role:           aws.String("arn:aws:iam::778743527532:role/ecsServiceRole"),
+			ServiceName:    aws.String(name),
+			TaskDefinition: aws.String(r.Tasks[spec.Name]),
+		}
+
+		for _, port := range spec.Ports {
+			creq.LoadBalancers = append(creq.LoadBalancers, &ecs.LoadBalancer{
+				ContainerName:    aws.String("main"),
+				ContainerPort:    aws.Long(int64(port)),
+				LoadBalancerName: aws.String(app.Outputs["Balancer"]),
+			})
+		}
+
+		_, err := models.ECS().CreateService(creq)
+
+		return err
+	}
+
+	_, err = models.ECS().UpdateService(&ecs.UpdateServiceInput{
+		Cluster:        aws.String(r.Cluster),
+		Service:        aws.String(name),
+		DesiredCount:   aws.Long(int64(spec.Count)),
+		TaskDefinition: aws.String(r.Tasks[spec.Name]),
+	})
+
+	return err
+}
+
+// Remove deletes the ECS services backing r, scaling them to zero first so
+// ECS can drain running tasks before the service itself is torn down.
+func (s *Scheduler) Remove(ctx context.Context, r *models.Release) error {
+	specs, err := r.ProcessSpecs()
+
+	if err != nil {
+		return err
+	}
+
+	for _, spec := range specs {
+		name := s.serviceName(r, spec.Name)
+
+		models.ECS().UpdateService(&ecs.UpdateServiceInput{
+			Cluster:      aws.String(r.Cluster),
+			Service:      aws.String(name),
+			DesiredCount: aws.Long(0),
+		})
+
+		if _, err := models.ECS().DeleteService(&ecs.DeleteServiceInput{
+			Cluster: aws.String(r.Cluster),
+			Service: aws.String(name),
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Instances reports one Instance per ECS service backing r, carrying the
+// service's name as its Id and the service's status. The service's
+// individual tasks are not listed, and Started is left zero.
+func (s *Scheduler) Instances(ctx context.Context, r *models.Release) ([]models.Instance, error) {
+	specs, err := r.ProcessSpecs()
+
+	if err != nil {
+		return nil, err
+	}
+
+	instances := []models.Instance{}
+
+	for _, spec := range specs {
+		name := s.serviceName(r, spec.Name)
+
+		res, err := models.ECS().DescribeServices(&ecs.DescribeServicesInput{
+			Cluster:  aws.String(r.Cluster),
+			Services: []*string{aws.String(name)},
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, svc := range res.Services {
+			instances = append(instances, models.Instance{
+				Id:      name,
+				Process: spec.Name,
+				Status:  *svc.Status,
+			})
+		}
+	}
+
+	return instances, nil
+}
+
+// Tail is not yet implemented for the ECS scheduler; task logs live in
+// CloudWatch Logs and streaming them is tracked separately.
+func (s *Scheduler) Tail(ctx context.Context, r *models.Release, out io.Writer) error {
+	return fmt.Errorf("tail not implemented for ecs scheduler")
+}
+
+// SubmitCanary stands up a canary service for spec alongside the primary
+// one, attached to the same load balancer, starting at zero desired count.
+// It implements models.CanaryScheduler.
+func (s *Scheduler) SubmitCanary(ctx context.Context, r *models.Release, spec models.ProcessSpec, canary string) error {
+	app, err := models.GetApp(r.Cluster, r.App)
+
+	if err != nil {
+		return err
+	}
+
+	creq := &ecs.CreateServiceInput{
+		Cluster:        aws.String(r.Cluster),
+		DesiredCount:   aws.Long(0),
+		Role:           aws.String("arn:aws:iam::778743527532:role/ecsServiceRole"),
+		ServiceName:    aws.String(canary),
+		TaskDefinition: aws.String(r.Tasks[spec.Name]),
+	}
+
+	for _, port := range spec.Ports {
+		creq.LoadBalancers = append(creq.LoadBalancers, &ecs.LoadBalancer{
+			ContainerName:    aws.String("main"),
+			ContainerPort:    aws.Long(int64(port)),
+			LoadBalancerName: aws.String(app.Outputs["Balancer"]),
+		})
+	}
+
+	_, err = models.ECS().CreateService(creq)
+
+	return err
+}
+
+// ScaleCanary sets canary's desired count.
+func (s *Scheduler) ScaleCanary(ctx context.Context, r *models.Release, canary string, desired int64) error {
+	_, err := models.ECS().UpdateService(&ecs.UpdateServiceInput{
+		Cluster:      aws.String(r.Cluster),
+		Service:      aws.String(canary),
+		DesiredCount: aws.Long(desired),
+	})
+
+	return err
+}
+
+// CanaryHealthy reports whether canary is running at desired count with
+// zero unhealthy target-group hosts.
+func (s *Scheduler) CanaryHealthy(ctx context.Context, r *models.Release, canary string, desired int64) (bool, error) {
+	res, err := models.ECS().DescribeServices(&ecs.DescribeServicesInput{
+		Cluster:  aws.String(r.Cluster),
+		Services: []*string{aws.String(canary)},
+	})
+
+	if err != nil {
+		return false, err
+	}
+
+	if len(res.Services) < 1 {
+		return false, fmt.Errorf("canary service %s not found", canary)
+	}
+
+	svc := res.Services[0]
+
+	if svc.RunningCount == nil || *svc.RunningCount != desired {
+		return false, nil
+	}
+
+	app, err := models.GetApp(r.Cluster, r.App)
+
+	if err != nil {
+		return false, err
+	}
+
+	return s.canaryTargetsHealthy(r, app, canary)
+}
+
+// canaryTargetsHealthy reports whether every EC2 instance currently running
+// a task for canary is InService on app's load balancer. It's the "zero
+// unhealthy target-group hosts" half of the step gate, alongside the
+// running/desired count check in CanaryHealthy.
+func (s *Scheduler) canaryTargetsHealthy(r *models.Release, app *models.App, canary string) (bool, error) {
+	balancer := app.Outputs["Balancer"]
+
+	if balancer == "" {
+		return true, nil
+	}
+
+	tres, err := models.ECS().ListTasks(&ecs.ListTasksInput{
+		Cluster:     aws.String(r.Cluster),
+		ServiceName: aws.String(canary),
+	})
+
+	if err != nil {
+		return false, err
+	}
+
+	if len(tres.TaskArns) == 0 {
+		return false, nil
+	}
+
+	dres, err := models.ECS().DescribeTasks(&ecs.DescribeTasksInput{
+		Cluster: aws.String(r.Cluster),
+		Tasks:   tres.TaskArns,
+	})
+
+	if err != nil {
+		return false, err
+	}
+
+	containerInstances := map[string]bool{}
+
+	for _, task := range dres.Tasks {
+		if task.ContainerInstanceArn != nil {
+			containerInstances[*task.ContainerInstanceArn] = true
+		}
+	}
+
+	if len(containerInstances) == 0 {
+		return false, nil
+	}
+
+	arns := make([]*string, 0, len(containerInstances))
+
+	for arn := range containerInstances {
+		arns = append(arns, aws.String(arn))
+	}
+
+	cres, err := models.ECS().DescribeContainerInstances(&ecs.DescribeContainerInstancesInput{
+		Cluster:            aws.String(r.Cluster),
+		ContainerInstances: arns,
+	})
+
+	if err != nil {
+		return false, err
+	}
+
+	instances := []*elb.Instance{}
+
+	for _, ci := range cres.ContainerInstances {
+		if ci.Ec2InstanceId != nil {
+			instances = append(instances, &elb.Instance{InstanceId: ci.Ec2InstanceId})
+		}
+	}
+
+	if len(instances) == 0 {
+		return false, nil
+	}
+
+	hres, err := models.ELB().DescribeInstanceHealth(&elb.DescribeInstanceHealthInput{
+		LoadBalancerName: aws.String(balancer),
+		Instances:        instances,
+	})
+
+	if err != nil {
+		return false, err
+	}
+
+	for _, state := range hres.InstanceStates {
+		if state.State == nil || *state.State != "InService" {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// PromoteService updates service to taskDefinition at desired count. It's
+// used to roll a confirmed canary onto the primary service.
+func (s *Scheduler) PromoteService(ctx context.Context, r *models.Release, service, taskDefinition string, desired int64) error {
+	_, err := models.ECS().UpdateService(&ecs.UpdateServiceInput{
+		Cluster:        aws.String(r.Cluster),
+		Service:        aws.String(service),
+		TaskDefinition: aws.String(taskDefinition),
+		DesiredCount:   aws.Long(desired),
+	})
+
+	return err
+}
+
+// RemoveCanary tears down a canary service regardless of its current state,
+// logging but not failing on errors since callers use it on both success
+// and failure paths.
+func (s *Scheduler) RemoveCanary(ctx context.Context, r *models.Release, canary string) {
+	models.ECS().UpdateService(&ecs.UpdateServiceInput{
+		Cluster:      aws.String(r.Cluster),
+		Service:      aws.String(canary),
+		DesiredCount: aws.Long(0),
+	})
+
+	if _, err := models.ECS().DeleteService(&ecs.DeleteServiceInput{
+		Cluster: aws.String(r.Cluster),
+		Service: aws.String(canary),
+	}); err != nil {
+		fmt.Printf("err %+v\n", err)
+	}
+}
+
+func (s *Scheduler) family(r *models.Release, process string) string {
+	return fmt.Sprintf("%s-%s-%s", r.Cluster, r.App, process)
+}
+
+func (s *Scheduler) serviceName(r *models.Release, process string) string {
+	return fmt.Sprintf("%s-%s-%s", r.Cluster, r.App, process)
+}